@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/packer-plugin-sdk/communicator"
@@ -102,6 +103,11 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 			NetBridge:        b.config.NetBridge,
 		},
 		new(stepConfigureVNC),
+		&stepRelabelImages{
+			ImageLabel: b.config.SecLabelImageLabel,
+			OutputDir:  b.config.OutputDir,
+			Relabel:    b.config.SecLabelRelabel,
+		},
 		&stepRun{
 			DiskImage: b.config.DiskImage,
 		},
@@ -125,10 +131,17 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 		&commonsteps.StepCleanupTempKeys{
 			Comm: &b.config.CommConfig.Comm,
 		},
+		&stepCaptureDisk{
+			CaptureName:          b.config.CaptureName,
+			Format:               b.config.Format,
+			GuestAgentSocketPath: b.config.GuestAgentSocketPath,
+			OutputDir:            b.config.OutputDir,
+		},
 		&stepShutdown{
-			ShutdownTimeout: b.config.ShutdownTimeout,
-			ShutdownCommand: b.config.ShutdownCommand,
-			Comm:            &b.config.CommConfig.Comm,
+			ShutdownTimeout:      b.config.ShutdownTimeout,
+			ShutdownCommand:      b.config.ShutdownCommand,
+			Comm:                 &b.config.CommConfig.Comm,
+			GuestAgentSocketPath: b.config.GuestAgentSocketPath,
 		},
 		&stepConvertDisk{
 			DiskCompression: b.config.DiskCompression,
@@ -138,6 +151,10 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 			VMName:          b.config.VMName,
 			LibvirtImgArgs:  b.config.LibvirtImgArgs,
 		},
+		&stepVerifyBoot{
+			VerifyBoot: b.config.VerifyBoot,
+			Timeout:    b.config.VerifyBootTimeout,
+		},
 	)
 
 	// Setup the state bag
@@ -197,6 +214,12 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 	if ok {
 		artifact.state["diskPaths"] = diskpaths
 	}
+
+	// placed in state in step_capture_disk.go
+	capturepaths, ok := state.Get("libvirt_capture_paths").([]string)
+	if ok {
+		artifact.state["capturePaths"] = capturepaths
+	}
 	artifact.state["diskType"] = b.config.Format
 	artifact.state["diskSize"] = b.config.DiskSize
 	artifact.state["domainType"] = b.config.Accelerator
@@ -219,6 +242,8 @@ func (b *Builder) newDriver(libvirtBinary string) (Driver, error) {
 	driver := &LibvirtDriver{
 		LibvirtPath:    libvirtPath,
 		LibvirtImgPath: libvirtImgPath,
+		LaunchPrefix:   processLaunchPrefix(&b.config),
+		Cgroup:         b.config.ProcessCgroup,
 	}
 
 	if err := driver.Verify(); err != nil {
@@ -227,3 +252,32 @@ func (b *Builder) newDriver(libvirtBinary string) (Driver, error) {
 
 	return driver, nil
 }
+
+// processLaunchPrefix returns the command the libvirt binary is run through
+// to apply the configured CPU and I/O priority and security label.
+func processLaunchPrefix(config *Config) []string {
+	var prefix []string
+
+	if config.ProcessIONiceClass != "" {
+		prefix = append(prefix, "ionice", "-c", ioniceClasses[config.ProcessIONiceClass])
+	}
+
+	if config.ProcessNice != 0 {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(config.ProcessNice))
+	}
+
+	// The security label must be applied last, so it is the libvirt binary
+	// that gets executed under it.
+	switch config.SecLabelModel + "/" + config.SecLabelType {
+	case "selinux/static":
+		prefix = append(prefix, "runcon", config.SecLabelLabel)
+	case "selinux/none":
+		prefix = append(prefix, "runcon", "-t", "unconfined_t")
+	case "apparmor/static":
+		prefix = append(prefix, "aa-exec", "-p", config.SecLabelLabel, "--")
+	case "apparmor/none":
+		prefix = append(prefix, "aa-exec", "-p", "unconfined", "--")
+	}
+
+	return prefix
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestBuilder_ImplementsBuilder(t *testing.T) {
@@ -13,3 +14,38 @@ func TestBuilder_ImplementsBuilder(t *testing.T) {
 		t.Error("Builder must implement builder.")
 	}
 }
+
+func TestBuilder_ProcessLaunchPrefix(t *testing.T) {
+	c := &Config{}
+	assert.Empty(t, processLaunchPrefix(c), "default priority shouldn't wrap the libvirt binary")
+
+	c = &Config{
+		ProcessNice:        10,
+		ProcessIONiceClass: "idle",
+	}
+	expected := []string{"ionice", "-c", "3", "nice", "-n", "10"}
+	assert.Equal(t, expected, processLaunchPrefix(c), "unexpected launch prefix")
+
+	c = &Config{
+		ProcessNice:   10,
+		SecLabelModel: "selinux",
+		SecLabelType:  "static",
+		SecLabelLabel: "system_u:system_r:svirt_t:s0",
+	}
+	expected = []string{"nice", "-n", "10", "runcon", "system_u:system_r:svirt_t:s0"}
+	assert.Equal(t, expected, processLaunchPrefix(c), "security label should be applied last")
+
+	c = &Config{
+		SecLabelModel: "apparmor",
+		SecLabelType:  "none",
+	}
+	expected = []string{"aa-exec", "-p", "unconfined", "--"}
+	assert.Equal(t, expected, processLaunchPrefix(c), "unexpected launch prefix")
+
+	c = &Config{
+		SecLabelModel: "selinux",
+		SecLabelType:  "none",
+	}
+	expected = []string{"runcon", "-t", "unconfined_t"}
+	assert.Equal(t, expected, processLaunchPrefix(c), "unexpected launch prefix")
+}
@@ -11,7 +11,9 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/bootcommand"
 	"github.com/hashicorp/packer-plugin-sdk/common"
@@ -32,6 +34,32 @@ var accels = map[string]struct{}{
 	"whpx": {},
 }
 
+// kvmDevice is the device opened to check whether the kvm accelerator can be
+// used on the build machine.
+var kvmDevice = "/dev/kvm"
+
+// hypervFeatures maps the supported Hyper-V enlightenments to whether they
+// take a value.
+var hypervFeatures = map[string]bool{
+	"relaxed":         false,
+	"vapic":           false,
+	"spinlocks":       true,
+	"vpindex":         false,
+	"runtime":         false,
+	"synic":           false,
+	"stimer":          false,
+	"stimer_direct":   false,
+	"time":            false,
+	"reset":           false,
+	"crash":           false,
+	"frequencies":     false,
+	"reenlightenment": false,
+	"tlbflush":        false,
+	"ipi":             false,
+	"evmcs":           false,
+	"vendor_id":       true,
+}
+
 var diskInterface = map[string]bool{
 	"ide":         true,
 	"scsi":        true,
@@ -58,6 +86,22 @@ var diskDZeroes = map[string]bool{
 	"off":   true,
 }
 
+var secLabelModels = map[string]bool{
+	"selinux":  true,
+	"apparmor": true,
+}
+
+var secLabelTypes = map[string]bool{
+	"static": true,
+	"none":   true,
+}
+
+var ioniceClasses = map[string]string{
+	"realtime":    "1",
+	"best-effort": "2",
+	"idle":        "3",
+}
+
 type LibvirtImgArgs struct {
 	Convert []string `mapstructure:"convert" required:"false"`
 	Create  []string `mapstructure:"create" required:"false"`
@@ -82,6 +126,11 @@ type Config struct {
 	// accelerator you specified. When no accelerator is specified, Packer will try
 	// to use `kvm` if it is available but will default to `tcg` otherwise.
 	//
+	// Set this to `tcg` to force software emulation, for instance in CI
+	// containers where `/dev/kvm` is exposed but unusable. When `kvm` is
+	// specified, Packer fails at validation time if `/dev/kvm` can't be
+	// opened, rather than when the VM is launched.
+	//
 	// ~> The `hax` accelerator has issues attaching CDROM ISOs. This is an
 	// upstream issue which can be tracked
 	// [here](https://github.com/intel/haxm/issues/20).
@@ -114,6 +163,27 @@ type Config struct {
 	// If unset, no -bios option is passed to Libvirt, using the default of Libvirt.
 	// Also see the Libvirt documentation.
 	Firmware string `mapstructure:"firmware" required:"false"`
+	// The Hyper-V enlightenments to expose to the guest, mirroring the
+	// features of the libvirt `<hyperv>` element. Enlightenments make Windows
+	// guests run considerably faster and satisfy the platform checks some
+	// Windows components perform during provisioning. Allowed values are
+	// `relaxed`, `vapic`, `spinlocks=<retries>`, `vpindex`, `runtime`, `synic`,
+	// `stimer`, `stimer_direct`, `time`, `reset`, `crash`, `frequencies`,
+	// `reenlightenment`, `tlbflush`, `ipi`, `evmcs` and `vendor_id=<id>`. The
+	// `spinlocks` retries must be at least `4095`. `synic`, `ipi` and
+	// `tlbflush` require `vpindex`, `stimer` requires both `synic` and
+	// `time`, `stimer_direct` requires `stimer`, and `evmcs` requires
+	// `vapic`. For example:
+	//
+	// ```hcl
+	// hyperv_features = ["relaxed", "vapic", "spinlocks=8191", "vpindex", "synic", "stimer", "time"]
+	// ```
+	//
+	// When set, the VM uses the `host` CPU model with the requested
+	// enlightenments, which requires the `kvm` accelerator. When `-cpu` is
+	// set in `libvirtargs`, the enlightenments are appended to that CPU
+	// model instead. Unset by default.
+	HypervFeatures []string `mapstructure:"hyperv_features" required:"false"`
 	// The interface to use for the disk. Allowed values include any of `ide`,
 	// `scsi`, `virtio` or `virtio-scsi`^\*. Note also that any boot commands
 	// or kickstart type scripts must have proper adjustments for resulting
@@ -353,12 +423,87 @@ type Config struct {
 	// some platforms. For example libvirt-kvm, or libvirt-system-i386 may be a
 	// better choice for some systems.
 	LibvirtBinary string `mapstructure:"libvirt_binary" required:"false"`
+	// The niceness to run the libvirt process with, from `-20` (highest
+	// priority) to `19` (lowest priority). This is useful to keep image
+	// builds in the background on developer workstations and shared hosts.
+	// Setting a negative value usually requires elevated privileges. Defaults
+	// to `0`, which keeps the niceness Packer runs with.
+	//
+	// **NB** This doesn't work on Windows.
+	ProcessNice int `mapstructure:"process_nice" required:"false"`
+	// The I/O scheduling class to run the libvirt process with, using
+	// `ionice`. Allowed values are `idle`, `best-effort` or `realtime`. The
+	// `realtime` class requires elevated privileges. Unset by default, which
+	// keeps the I/O priority Packer runs with.
+	//
+	// **NB** This only works in Linux based OSes.
+	ProcessIONiceClass string `mapstructure:"process_ionice_class" required:"false"`
+	// The cgroup to move the libvirt process into once started, relative to
+	// the cgroup v2 hierarchy mounted at `/sys/fs/cgroup`, for instance
+	// `background.slice/packer`. The cgroup must already exist, be writable
+	// by the user running Packer and be a leaf cgroup: cgroup v2 doesn't
+	// allow processes in a cgroup that has controllers enabled for its
+	// children, such as most slices. Unset by default.
+	//
+	// **NB** This only works in Linux based OSes.
+	ProcessCgroup string `mapstructure:"process_cgroup" required:"false"`
+	// The security driver confining the libvirt process, as the `model`
+	// attribute of a libvirt `<seclabel>` element. Allowed values are `selinux`
+	// or `apparmor`. Unset by default, which leaves the process and the images
+	// with the labels the host assigns them.
+	//
+	// **NB** This only works in Linux based OSes.
+	SecLabelModel string `mapstructure:"seclabel_model" required:"false"`
+	// How the libvirt process is labeled when `seclabel_model` is set.
+	// Allowed values are `static` or `none`. With `static` the process runs
+	// under `seclabel_label`, and with `none` the process runs unconfined.
+	// Required when `seclabel_model` is set.
+	SecLabelType string `mapstructure:"seclabel_type" required:"false"`
+	// The label the libvirt process runs under when `seclabel_type` is
+	// `static`. This is an SELinux context such as
+	// `system_u:system_r:svirt_t:s0:c392,c662` for the `selinux` model, or an
+	// AppArmor profile name for the `apparmor` model.
+	SecLabelLabel string `mapstructure:"seclabel_label" required:"false"`
+	// Relabel the output directory, the disk images and the attached ISO,
+	// floppy and CD files with `seclabel_image_label` before starting the VM.
+	// This is needed on hardened hosts when images live outside of the
+	// directories the policy allows the libvirt process to access. The
+	// output directory keeps the new label, while the original labels of the
+	// ISO, floppy and CD files are restored once the build finishes. Only
+	// supported with the `selinux` model. Defaults to false.
+	SecLabelRelabel bool `mapstructure:"seclabel_relabel" required:"false"`
+	// The SELinux context images are relabeled with when `seclabel_relabel`
+	// is true, for instance `system_u:object_r:svirt_image_t:s0:c392,c662`.
+	SecLabelImageLabel string `mapstructure:"seclabel_image_label" required:"false"`
 	// Enable QMP socket. Location is specified by `qmp_socket_path`. Defaults
 	// to false.
 	QMPEnable bool `mapstructure:"qmp_enable" required:"false"`
 	// QMP Socket Path when `qmp_enable` is true. Defaults to
 	// `output_directory`/`vm_name`.monitor.
 	QMPSocketPath string `mapstructure:"qmp_socket_path" required:"false"`
+	// When set, Packer captures a copy of the VM disks once provisioning has
+	// finished and before the VM is shut down. The VM is paused over QMP while
+	// the disks are copied and resumed afterwards, so the capture is
+	// consistent without a full shutdown cycle. This is useful to produce
+	// intermediate images for cache or layer workflows. The copies are
+	// written to `output_directory` using this name, with `-#` appended for
+	// additional disks. The name must not clash with the VM disks and can't
+	// contain path separators. The captures are standalone, sparse images
+	// in `format`, also when `use_backing_file` is true. A communicator is
+	// required, so the capture happens once provisioning has actually
+	// finished. This option automatically enables the QMP socket. Unset by
+	// default.
+	CaptureName string `mapstructure:"capture_name" required:"false"`
+	// Attach a guest agent channel to the VM. When the guest agent is
+	// running in the guest, Packer uses it to freeze the guest filesystems
+	// before capturing the disks (see `capture_name`) and before halting the
+	// VM without a `shutdown_command`, so the captured filesystems are
+	// consistent. Location is specified by `guest_agent_socket_path`. Defaults
+	// to false.
+	GuestAgentEnable bool `mapstructure:"guest_agent_enable" required:"false"`
+	// Guest agent socket path when `guest_agent_enable` is true. Defaults
+	// to `output_directory`/`vm_name`.agent.
+	GuestAgentSocketPath string `mapstructure:"guest_agent_socket_path" required:"false"`
 	// If true, do not pass a -display option
 	// to libvirt, allowing it to choose the default. This may be needed when running
 	// under macOS, and getting errors about sdl not being available.
@@ -394,6 +539,19 @@ type Config struct {
 	// `virtio-scsi`. The Libvirt builder uses `virtio` by default.
 	// Some ARM64 images require `virtio-scsi`.
 	CDROMInterface string `mapstructure:"cdrom_interface" required:"false"`
+	// Once the image is finalized, boot a throwaway copy-on-write overlay of
+	// it and wait for the guest to come up, to catch images that build fine
+	// but don't boot. The guest is considered up once the guest agent answers
+	// when `guest_agent_enable` is true, or once the SSH or WinRM service of
+	// the communicator answers otherwise. The verification VM is then
+	// destroyed, leaving the image untouched. The VM is started with the same
+	// settings as the build VM, except for the installation media and the
+	// drives set in `libvirtargs`, which would point at the image itself.
+	// Defaults to false.
+	VerifyBoot bool `mapstructure:"verify_boot" required:"false"`
+	// The amount of time to wait for the verification VM to come up when
+	// `verify_boot` is true. This defaults to `5m`.
+	VerifyBootTimeout time.Duration `mapstructure:"verify_boot_timeout" required:"false"`
 
 	// TODO(mitchellh): deprecate
 	RunOnce bool `mapstructure:"run_once"`
@@ -460,20 +618,21 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 		if runtime.GOOS == "windows" {
 			c.Accelerator = "tcg"
 		} else {
-			// /dev/kvm is a kernel module that may be loaded if kvm is
-			// installed and the host supports VT-x extensions. To make sure
-			// this will actually work we need to os.Open() it. If os.Open fails
-			// the kernel module was not installed or loaded correctly.
-			if fp, err := os.Open("/dev/kvm"); err != nil {
+			if err := kvmAvailable(); err != nil {
 				c.Accelerator = "tcg"
 			} else {
-				fp.Close()
 				c.Accelerator = "kvm"
 			}
 		}
 		log.Printf("use detected accelerator: %s", c.Accelerator)
 	} else {
 		log.Printf("use specified accelerator: %s", c.Accelerator)
+		if c.Accelerator == "kvm" {
+			if err := kvmAvailable(); err != nil {
+				errs = packersdk.MultiErrorAppend(
+					errs, fmt.Errorf("kvm accelerator is not available: %s", err))
+			}
+		}
 	}
 
 	if c.MachineType == "" {
@@ -572,6 +731,10 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 			errs, errors.New("invalid accelerator, only 'kvm', 'tcg', 'xen', 'hax', 'hvf', 'whpx', or 'none' are allowed"))
 	}
 
+	if len(c.HypervFeatures) > 0 {
+		errs = packersdk.MultiErrorAppend(errs, c.prepareHypervFeatures()...)
+	}
+
 	if _, ok := diskInterface[c.DiskInterface]; !ok {
 		errs = packersdk.MultiErrorAppend(
 			errs, errors.New("unrecognized disk interface type"))
@@ -615,12 +778,86 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 			errs, fmt.Errorf("vnc_port_min must be less than vnc_port_max"))
 	}
 
+	if c.ProcessNice < -20 || c.ProcessNice > 19 {
+		errs = packersdk.MultiErrorAppend(
+			errs, fmt.Errorf("process_nice must be between -20 and 19"))
+	}
+	if c.ProcessNice != 0 && runtime.GOOS == "windows" {
+		errs = packersdk.MultiErrorAppend(
+			errs, fmt.Errorf("process_nice is not supported on Windows"))
+	}
+
+	if c.ProcessIONiceClass != "" {
+		if _, ok := ioniceClasses[c.ProcessIONiceClass]; !ok {
+			errs = packersdk.MultiErrorAppend(
+				errs, errors.New("invalid process_ionice_class, only 'idle', 'best-effort' or 'realtime' are allowed"))
+		}
+		if runtime.GOOS != "linux" {
+			errs = packersdk.MultiErrorAppend(
+				errs, fmt.Errorf("process_ionice_class is only supported in Linux based OSes"))
+		}
+	}
+
+	if c.ProcessCgroup != "" {
+		for _, name := range strings.Split(c.ProcessCgroup, "/") {
+			if name == ".." {
+				errs = packersdk.MultiErrorAppend(
+					errs, fmt.Errorf("process_cgroup must not contain '..': %s", c.ProcessCgroup))
+				break
+			}
+		}
+		if runtime.GOOS != "linux" {
+			errs = packersdk.MultiErrorAppend(
+				errs, fmt.Errorf("process_cgroup is only supported in Linux based OSes"))
+		}
+	}
+
+	if c.SecLabelModel != "" {
+		if !secLabelModels[c.SecLabelModel] {
+			errs = packersdk.MultiErrorAppend(
+				errs, errors.New("invalid seclabel_model, only 'selinux' or 'apparmor' are allowed"))
+		}
+		if !secLabelTypes[c.SecLabelType] {
+			errs = packersdk.MultiErrorAppend(
+				errs, errors.New("invalid seclabel_type, only 'static' or 'none' are allowed"))
+		}
+		if c.SecLabelType == "static" && c.SecLabelLabel == "" {
+			errs = packersdk.MultiErrorAppend(
+				errs, errors.New("seclabel_label must be set when seclabel_type is static"))
+		}
+		if c.SecLabelType != "static" && c.SecLabelLabel != "" {
+			errs = packersdk.MultiErrorAppend(
+				errs, errors.New("seclabel_label can only be set when seclabel_type is static"))
+		}
+		if c.SecLabelRelabel {
+			if c.SecLabelModel != "selinux" {
+				errs = packersdk.MultiErrorAppend(
+					errs, errors.New("seclabel_relabel is only supported with the selinux seclabel_model"))
+			}
+			if c.SecLabelImageLabel == "" {
+				errs = packersdk.MultiErrorAppend(
+					errs, errors.New("seclabel_image_label must be set when seclabel_relabel is true"))
+			}
+		}
+		if runtime.GOOS != "linux" {
+			errs = packersdk.MultiErrorAppend(
+				errs, fmt.Errorf("seclabel_model is only supported in Linux based OSes"))
+		}
+	} else if c.SecLabelType != "" || c.SecLabelLabel != "" || c.SecLabelRelabel {
+		errs = packersdk.MultiErrorAppend(
+			errs, errors.New("seclabel_model must be set to configure the seclabel"))
+	}
+
 	if c.NetBridge != "" && runtime.GOOS != "linux" {
 		errs = packersdk.MultiErrorAppend(
 			errs, fmt.Errorf("net_bridge is only supported in Linux based OSes"))
 	}
 
-	if c.NetBridge != "" || c.VNCUsePassword {
+	if c.CaptureName != "" {
+		errs = packersdk.MultiErrorAppend(errs, c.prepareCaptureName()...)
+	}
+
+	if c.NetBridge != "" || c.VNCUsePassword || c.CaptureName != "" {
 		c.QMPEnable = true
 	}
 
@@ -629,6 +866,24 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 		c.QMPSocketPath = filepath.Join(c.OutputDir, socketName)
 	}
 
+	if c.GuestAgentEnable {
+		if c.GuestAgentSocketPath == "" {
+			socketName := fmt.Sprintf("%s.agent", c.VMName)
+			c.GuestAgentSocketPath = filepath.Join(c.OutputDir, socketName)
+		}
+	} else {
+		c.GuestAgentSocketPath = ""
+	}
+
+	if c.VerifyBootTimeout == 0 {
+		c.VerifyBootTimeout = 5 * time.Minute
+	}
+
+	if c.VerifyBoot && !c.GuestAgentEnable && (c.CommConfig.Comm.Type == "none" || c.NetBridge != "") {
+		errs = packersdk.MultiErrorAppend(
+			errs, errors.New("verify_boot requires guest_agent_enable when no communicator is set or net_bridge is used"))
+	}
+
 	if c.LibvirtArgs == nil {
 		c.LibvirtArgs = make([][]string, 0)
 	}
@@ -640,3 +895,107 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 	return warnings, nil
 
 }
+
+// kvmAvailable checks whether the kvm accelerator can be used.
+func kvmAvailable() error {
+	// /dev/kvm is a kernel module that may be loaded if kvm is
+	// installed and the host supports VT-x extensions. To make sure
+	// this will actually work we need to open it read-write, as libvirt
+	// does to create the VM: the device is often readable by everyone but
+	// only writable by the kvm group. If opening fails the kernel module
+	// was not installed or loaded correctly, or we lack the permissions.
+	fp, err := os.OpenFile(kvmDevice, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+// prepareCaptureName checks that the disk captures can't overwrite the VM
+// disks, which are still in use while they are copied.
+func (c *Config) prepareCaptureName() []error {
+	// Without a communicator, nothing waits for the guest installation to
+	// finish before the capture
+	if c.CommConfig.Comm.Type == "none" {
+		return []error{errors.New("capture_name can't be used when communicator is none")}
+	}
+
+	if strings.ContainsAny(c.CaptureName, `/\`) || c.CaptureName == "." || c.CaptureName == ".." {
+		return []error{fmt.Errorf("capture_name must be a file name, not a path: %s", c.CaptureName)}
+	}
+
+	// The names used by the VM disks and by the disk conversion
+	reserved := map[string]bool{
+		c.VMName:              true,
+		c.VMName + ".convert": true,
+	}
+	for i := range c.AdditionalDiskSize {
+		reserved[fmt.Sprintf("%s-%d", c.VMName, i+1)] = true
+	}
+
+	var errs []error
+	for i := 0; i <= len(c.AdditionalDiskSize); i++ {
+		name := c.CaptureName
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d", c.CaptureName, i)
+		}
+		if reserved[name] {
+			errs = append(errs, fmt.Errorf("capture_name would overwrite the VM disk %s", name))
+		}
+	}
+
+	return errs
+}
+
+func (c *Config) prepareHypervFeatures() []error {
+	var errs []error
+
+	if c.Accelerator != "kvm" {
+		errs = append(errs, errors.New("hyperv_features can only be used with the kvm accelerator"))
+	}
+
+	enabled := make(map[string]bool)
+	for _, feature := range c.HypervFeatures {
+		name := strings.SplitN(feature, "=", 2)[0]
+		hasValue, ok := hypervFeatures[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unrecognized Hyper-V feature: %s", feature))
+			continue
+		}
+		if hasValue != strings.Contains(feature, "=") {
+			if hasValue {
+				errs = append(errs, fmt.Errorf("Hyper-V feature %s requires a value", name))
+			} else {
+				errs = append(errs, fmt.Errorf("Hyper-V feature %s doesn't take a value", name))
+			}
+			continue
+		}
+		if name == "spinlocks" {
+			retries, err := strconv.ParseInt(strings.SplitN(feature, "=", 2)[1], 0, 64)
+			if err != nil || retries < 4095 {
+				errs = append(errs, fmt.Errorf("Hyper-V spinlocks retries must be a number of at least 4095"))
+			}
+		}
+		enabled[name] = true
+	}
+
+	if enabled["synic"] && !enabled["vpindex"] {
+		errs = append(errs, errors.New("Hyper-V feature synic requires vpindex"))
+	}
+	if enabled["stimer"] && !(enabled["synic"] && enabled["time"]) {
+		errs = append(errs, errors.New("Hyper-V feature stimer requires synic and time"))
+	}
+	if enabled["stimer_direct"] && !enabled["stimer"] {
+		errs = append(errs, errors.New("Hyper-V feature stimer_direct requires stimer"))
+	}
+	if enabled["evmcs"] && !enabled["vapic"] {
+		errs = append(errs, errors.New("Hyper-V feature evmcs requires vapic"))
+	}
+	for _, name := range []string{"ipi", "tlbflush"} {
+		if enabled[name] && !enabled["vpindex"] {
+			errs = append(errs, fmt.Errorf("Hyper-V feature %s requires vpindex", name))
+		}
+	}
+
+	return errs
+}
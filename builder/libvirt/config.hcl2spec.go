@@ -100,6 +100,7 @@ type FlatConfig struct {
 	AdditionalDiskSize        []string          `mapstructure:"disk_additional_size" required:"false" cty:"disk_additional_size" hcl:"disk_additional_size"`
 	CpuCount                  *int              `mapstructure:"cpus" required:"false" cty:"cpus" hcl:"cpus"`
 	Firmware                  *string           `mapstructure:"firmware" required:"false" cty:"firmware" hcl:"firmware"`
+	HypervFeatures            []string          `mapstructure:"hyperv_features" required:"false" cty:"hyperv_features" hcl:"hyperv_features"`
 	DiskInterface             *string           `mapstructure:"disk_interface" required:"false" cty:"disk_interface" hcl:"disk_interface"`
 	DiskSize                  *string           `mapstructure:"disk_size" required:"false" cty:"disk_size" hcl:"disk_size"`
 	SkipResizeDisk            *bool             `mapstructure:"skip_resize_disk" required:"false" cty:"skip_resize_disk" hcl:"skip_resize_disk"`
@@ -120,8 +121,19 @@ type FlatConfig struct {
 	LibvirtArgs               [][]string        `mapstructure:"libvirtargs" required:"false" cty:"libvirtargs" hcl:"libvirtargs"`
 	LibvirtImgArgs            *FlatLibvirtImgArgs  `mapstructure:"libvirt_img_args" required:"false" cty:"libvirt_img_args" hcl:"libvirt_img_args"`
 	LibvirtBinary             *string           `mapstructure:"libvirt_binary" required:"false" cty:"libvirt_binary" hcl:"libvirt_binary"`
+	ProcessNice               *int              `mapstructure:"process_nice" required:"false" cty:"process_nice" hcl:"process_nice"`
+	ProcessIONiceClass        *string           `mapstructure:"process_ionice_class" required:"false" cty:"process_ionice_class" hcl:"process_ionice_class"`
+	ProcessCgroup             *string           `mapstructure:"process_cgroup" required:"false" cty:"process_cgroup" hcl:"process_cgroup"`
+	SecLabelModel             *string           `mapstructure:"seclabel_model" required:"false" cty:"seclabel_model" hcl:"seclabel_model"`
+	SecLabelType              *string           `mapstructure:"seclabel_type" required:"false" cty:"seclabel_type" hcl:"seclabel_type"`
+	SecLabelLabel             *string           `mapstructure:"seclabel_label" required:"false" cty:"seclabel_label" hcl:"seclabel_label"`
+	SecLabelRelabel           *bool             `mapstructure:"seclabel_relabel" required:"false" cty:"seclabel_relabel" hcl:"seclabel_relabel"`
+	SecLabelImageLabel        *string           `mapstructure:"seclabel_image_label" required:"false" cty:"seclabel_image_label" hcl:"seclabel_image_label"`
 	QMPEnable                 *bool             `mapstructure:"qmp_enable" required:"false" cty:"qmp_enable" hcl:"qmp_enable"`
 	QMPSocketPath             *string           `mapstructure:"qmp_socket_path" required:"false" cty:"qmp_socket_path" hcl:"qmp_socket_path"`
+	CaptureName               *string           `mapstructure:"capture_name" required:"false" cty:"capture_name" hcl:"capture_name"`
+	GuestAgentEnable          *bool             `mapstructure:"guest_agent_enable" required:"false" cty:"guest_agent_enable" hcl:"guest_agent_enable"`
+	GuestAgentSocketPath      *string           `mapstructure:"guest_agent_socket_path" required:"false" cty:"guest_agent_socket_path" hcl:"guest_agent_socket_path"`
 	UseDefaultDisplay         *bool             `mapstructure:"use_default_display" required:"false" cty:"use_default_display" hcl:"use_default_display"`
 	Display                   *string           `mapstructure:"display" required:"false" cty:"display" hcl:"display"`
 	VNCBindAddress            *string           `mapstructure:"vnc_bind_address" required:"false" cty:"vnc_bind_address" hcl:"vnc_bind_address"`
@@ -130,6 +142,8 @@ type FlatConfig struct {
 	VNCPortMax                *int              `mapstructure:"vnc_port_max" cty:"vnc_port_max" hcl:"vnc_port_max"`
 	VMName                    *string           `mapstructure:"vm_name" required:"false" cty:"vm_name" hcl:"vm_name"`
 	CDROMInterface            *string           `mapstructure:"cdrom_interface" required:"false" cty:"cdrom_interface" hcl:"cdrom_interface"`
+	VerifyBoot                *bool             `mapstructure:"verify_boot" required:"false" cty:"verify_boot" hcl:"verify_boot"`
+	VerifyBootTimeout         *string           `mapstructure:"verify_boot_timeout" required:"false" cty:"verify_boot_timeout" hcl:"verify_boot_timeout"`
 	RunOnce                   *bool             `mapstructure:"run_once" cty:"run_once" hcl:"run_once"`
 }
 
@@ -235,6 +249,7 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"disk_additional_size":         &hcldec.AttrSpec{Name: "disk_additional_size", Type: cty.List(cty.String), Required: false},
 		"cpus":                         &hcldec.AttrSpec{Name: "cpus", Type: cty.Number, Required: false},
 		"firmware":                     &hcldec.AttrSpec{Name: "firmware", Type: cty.String, Required: false},
+		"hyperv_features":              &hcldec.AttrSpec{Name: "hyperv_features", Type: cty.List(cty.String), Required: false},
 		"disk_interface":               &hcldec.AttrSpec{Name: "disk_interface", Type: cty.String, Required: false},
 		"disk_size":                    &hcldec.AttrSpec{Name: "disk_size", Type: cty.String, Required: false},
 		"skip_resize_disk":             &hcldec.AttrSpec{Name: "skip_resize_disk", Type: cty.Bool, Required: false},
@@ -255,8 +270,19 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"libvirtargs":                  &hcldec.AttrSpec{Name: "libvirtargs", Type: cty.List(cty.List(cty.String)), Required: false},
 		"libvirt_img_args":             &hcldec.BlockSpec{TypeName: "libvirt_img_args", Nested: hcldec.ObjectSpec((*FlatLibvirtImgArgs)(nil).HCL2Spec())},
 		"libvirt_binary":               &hcldec.AttrSpec{Name: "libvirt_binary", Type: cty.String, Required: false},
+		"process_nice":                 &hcldec.AttrSpec{Name: "process_nice", Type: cty.Number, Required: false},
+		"process_ionice_class":         &hcldec.AttrSpec{Name: "process_ionice_class", Type: cty.String, Required: false},
+		"process_cgroup":               &hcldec.AttrSpec{Name: "process_cgroup", Type: cty.String, Required: false},
+		"seclabel_model":               &hcldec.AttrSpec{Name: "seclabel_model", Type: cty.String, Required: false},
+		"seclabel_type":                &hcldec.AttrSpec{Name: "seclabel_type", Type: cty.String, Required: false},
+		"seclabel_label":               &hcldec.AttrSpec{Name: "seclabel_label", Type: cty.String, Required: false},
+		"seclabel_relabel":             &hcldec.AttrSpec{Name: "seclabel_relabel", Type: cty.Bool, Required: false},
+		"seclabel_image_label":         &hcldec.AttrSpec{Name: "seclabel_image_label", Type: cty.String, Required: false},
 		"qmp_enable":                   &hcldec.AttrSpec{Name: "qmp_enable", Type: cty.Bool, Required: false},
 		"qmp_socket_path":              &hcldec.AttrSpec{Name: "qmp_socket_path", Type: cty.String, Required: false},
+		"capture_name":                 &hcldec.AttrSpec{Name: "capture_name", Type: cty.String, Required: false},
+		"guest_agent_enable":           &hcldec.AttrSpec{Name: "guest_agent_enable", Type: cty.Bool, Required: false},
+		"guest_agent_socket_path":      &hcldec.AttrSpec{Name: "guest_agent_socket_path", Type: cty.String, Required: false},
 		"use_default_display":          &hcldec.AttrSpec{Name: "use_default_display", Type: cty.Bool, Required: false},
 		"display":                      &hcldec.AttrSpec{Name: "display", Type: cty.String, Required: false},
 		"vnc_bind_address":             &hcldec.AttrSpec{Name: "vnc_bind_address", Type: cty.String, Required: false},
@@ -265,6 +291,8 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"vnc_port_max":                 &hcldec.AttrSpec{Name: "vnc_port_max", Type: cty.Number, Required: false},
 		"vm_name":                      &hcldec.AttrSpec{Name: "vm_name", Type: cty.String, Required: false},
 		"cdrom_interface":              &hcldec.AttrSpec{Name: "cdrom_interface", Type: cty.String, Required: false},
+		"verify_boot":                  &hcldec.AttrSpec{Name: "verify_boot", Type: cty.Bool, Required: false},
+		"verify_boot_timeout":          &hcldec.AttrSpec{Name: "verify_boot_timeout", Type: cty.String, Required: false},
 		"run_once":                     &hcldec.AttrSpec{Name: "run_once", Type: cty.Bool, Required: false},
 	}
 	return s
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"testing"
 	"time"
 
@@ -89,6 +90,107 @@ func TestBuilderPrepare_Defaults(t *testing.T) {
 	}
 }
 
+func TestBuilderPrepare_Accelerator(t *testing.T) {
+	defer func(device string) { kvmDevice = device }(kvmDevice)
+
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	// Test no kvm device
+	kvmDevice = filepath.Join(td, "kvm")
+	config := testConfig()
+	config["accelerator"] = "kvm"
+	var c Config
+	warns, err := c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error when kvm is requested but unavailable")
+	}
+
+	// Test forcing software emulation
+	config["accelerator"] = "tcg"
+	c = Config{}
+	warns, err = c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	// Test detection without kvm device
+	delete(config, "accelerator")
+	c = Config{}
+	warns, err = c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if c.Accelerator != "tcg" {
+		t.Fatalf("bad accelerator: %s", c.Accelerator)
+	}
+
+	// Test kvm device
+	if err := ioutil.WriteFile(kvmDevice, nil, 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	config["accelerator"] = "kvm"
+	c = Config{}
+	warns, err = c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+}
+
+func TestBuilderPrepare_HypervFeatures(t *testing.T) {
+	testcases := []struct {
+		Accelerator string
+		Features    []string
+		Valid       bool
+	}{
+		{"kvm", []string{"relaxed", "vapic", "spinlocks=8191"}, true},
+		{"kvm", []string{"vpindex", "synic", "stimer", "time", "vendor_id=KVMKVMKVM"}, true},
+		{"tcg", []string{"relaxed"}, false},
+		{"kvm", []string{"unknown"}, false},
+		{"kvm", []string{"spinlocks"}, false},
+		{"kvm", []string{"spinlocks=10"}, false},
+		{"kvm", []string{"relaxed=on"}, false},
+		{"kvm", []string{"synic"}, false},
+		{"kvm", []string{"vpindex", "synic", "stimer"}, false},
+		{"kvm", []string{"vpindex", "synic", "stimer", "time", "stimer_direct"}, true},
+		{"kvm", []string{"stimer_direct"}, false},
+		{"kvm", []string{"vpindex", "ipi", "tlbflush"}, true},
+		{"kvm", []string{"ipi"}, false},
+		{"kvm", []string{"tlbflush"}, false},
+		{"kvm", []string{"vapic", "evmcs"}, true},
+		{"kvm", []string{"evmcs"}, false},
+	}
+
+	for _, tc := range testcases {
+		c := Config{
+			Accelerator:    tc.Accelerator,
+			HypervFeatures: tc.Features,
+		}
+		errs := c.prepareHypervFeatures()
+		if tc.Valid && len(errs) > 0 {
+			t.Fatalf("should not have error for %#v: %s", tc.Features, errs)
+		}
+		if !tc.Valid && len(errs) == 0 {
+			t.Fatalf("should have error for %#v", tc.Features)
+		}
+	}
+}
+
 func TestBuilderPrepare_VNCBindAddress(t *testing.T) {
 	var c Config
 	config := testConfig()
@@ -639,6 +741,248 @@ func TestBuilderPrepare_VNCPassword(t *testing.T) {
 	}
 }
 
+func TestBuilderPrepare_CaptureName(t *testing.T) {
+	var c Config
+	config := testConfig()
+	config["capture_name"] = "packer-foo-capture"
+	config["output_directory"] = "not-a-real-directory"
+
+	warns, err := c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if !c.QMPEnable {
+		t.Fatalf("capture_name should enable the QMP socket")
+	}
+
+	config["capture_name"] = "packer-foo"
+	c = Config{}
+	warns, err = c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error when capture_name is vm_name")
+	}
+
+	// Captures must not overwrite the additional disks, the conversion
+	// target, nor be written outside of the output directory
+	config["disk_additional_size"] = []string{"50M", "50M"}
+	names := []string{
+		"packer-foo-1",
+		"packer-foo-2",
+		"packer-foo.convert",
+		"../packer-foo-capture",
+		"capture/packer-foo",
+		"..",
+	}
+	for _, name := range names {
+		config["capture_name"] = name
+		c = Config{}
+		_, err = c.Prepare(config)
+		if err == nil {
+			t.Fatalf("should have error for capture_name %s", name)
+		}
+	}
+
+	// Without a communicator, the capture would happen mid-installation
+	config["capture_name"] = "packer-foo-capture"
+	config["communicator"] = "none"
+	c = Config{}
+	_, err = c.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error when communicator is none")
+	}
+}
+
+func TestBuilderPrepare_GuestAgent(t *testing.T) {
+	var c Config
+	config := testConfig()
+	config["guest_agent_enable"] = true
+	config["output_directory"] = "not-a-real-directory"
+
+	warns, err := c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	expected := filepath.Join("not-a-real-directory", "packer-foo.agent")
+	if c.GuestAgentSocketPath != expected {
+		t.Fatalf("Bad guest agent socket Path: %s", c.GuestAgentSocketPath)
+	}
+
+	config["guest_agent_enable"] = false
+	config["guest_agent_socket_path"] = "agent.sock"
+	c = Config{}
+	warns, err = c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if c.GuestAgentSocketPath != "" {
+		t.Fatalf("guest agent socket path should be unset when guest agent is disabled: %s", c.GuestAgentSocketPath)
+	}
+}
+
+func TestBuilderPrepare_VerifyBoot(t *testing.T) {
+	var c Config
+	config := testConfig()
+	config["verify_boot"] = true
+
+	warns, err := c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if c.VerifyBootTimeout != 5*time.Minute {
+		t.Fatalf("bad verify boot timeout: %s", c.VerifyBootTimeout)
+	}
+
+	// Without a communicator, only the guest agent can tell the guest is up
+	config["communicator"] = "none"
+	c = Config{}
+	_, err = c.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["guest_agent_enable"] = true
+	config["verify_boot_timeout"] = "10m"
+	c = Config{}
+	warns, err = c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if c.VerifyBootTimeout != 10*time.Minute {
+		t.Fatalf("bad verify boot timeout: %s", c.VerifyBootTimeout)
+	}
+}
+
+func TestBuilderPrepare_ProcessPriority(t *testing.T) {
+	var c Config
+	config := testConfig()
+
+	// Test bad
+	config["process_nice"] = 20
+	warns, err := c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Test bad
+	config["process_nice"] = 10
+	config["process_ionice_class"] = "lowest"
+	c = Config{}
+	warns, err = c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Test bad
+	config["process_ionice_class"] = "idle"
+	config["process_cgroup"] = "background.slice/../../../tmp"
+	c = Config{}
+	warns, err = c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	if runtime.GOOS == "windows" {
+		// Test bad
+		delete(config, "process_ionice_class")
+		delete(config, "process_cgroup")
+		c = Config{}
+		_, err = c.Prepare(config)
+		if err == nil {
+			t.Fatal("should have error for process_nice on Windows")
+		}
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	// Test good
+	config["process_cgroup"] = "background.slice/packer"
+	c = Config{}
+	warns, err = c.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+}
+
+func TestBuilderPrepare_SecLabel(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("seclabel is only supported in Linux based OSes")
+	}
+
+	testcases := []struct {
+		Options map[string]interface{}
+		Valid   bool
+	}{
+		{map[string]interface{}{"seclabel_model": "selinux"}, false},
+		{map[string]interface{}{"seclabel_model": "selinux", "seclabel_type": "dynamic"}, false},
+		{map[string]interface{}{"seclabel_model": "selinux", "seclabel_type": "none"}, true},
+		{map[string]interface{}{"seclabel_model": "smack"}, false},
+		{map[string]interface{}{"seclabel_model": "apparmor", "seclabel_type": "none"}, true},
+		{map[string]interface{}{"seclabel_model": "apparmor", "seclabel_type": "static"}, false},
+		{map[string]interface{}{"seclabel_model": "apparmor", "seclabel_type": "static", "seclabel_label": "packer"}, true},
+		{map[string]interface{}{"seclabel_model": "selinux", "seclabel_type": "none", "seclabel_label": "system_u:system_r:svirt_t:s0"}, false},
+		{map[string]interface{}{"seclabel_model": "selinux", "seclabel_type": "none", "seclabel_relabel": true}, false},
+		{map[string]interface{}{"seclabel_model": "apparmor", "seclabel_type": "none", "seclabel_relabel": true, "seclabel_image_label": "packer"}, false},
+		{map[string]interface{}{"seclabel_model": "selinux", "seclabel_type": "none", "seclabel_relabel": true, "seclabel_image_label": "system_u:object_r:svirt_image_t:s0"}, true},
+		{map[string]interface{}{"seclabel_type": "none"}, false},
+	}
+
+	for _, tc := range testcases {
+		config := testConfig()
+		for k, v := range tc.Options {
+			config[k] = v
+		}
+
+		var c Config
+		warns, err := c.Prepare(config)
+		if len(warns) > 0 {
+			t.Fatalf("bad: %#v", warns)
+		}
+		if tc.Valid && err != nil {
+			t.Fatalf("should not have error for %#v: %s", tc.Options, err)
+		}
+		if !tc.Valid && err == nil {
+			t.Fatalf("should have error for %#v", tc.Options)
+		}
+	}
+}
+
 func TestCommConfigPrepare_BackwardsCompatibility(t *testing.T) {
 	var c Config
 	config := testConfig()
@@ -8,7 +8,9 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -33,12 +35,19 @@ type Driver interface {
 	// Libvirt executes the given command via libvirt-system-x86_64
 	Libvirt(libvirtArgs ...string) error
 
-	// wait on shutdown of the VM with option to cancel
+	// wait on shutdown of the VM with option to cancel. Once it returns
+	// true, the VM has exited and a new one can be run.
 	WaitForShutdown(<-chan struct{}) bool
 
 	// Libvirt executes the given command via libvirt-img
 	LibvirtImg(...string) error
 
+	// Relabel recursively sets the SELinux context of the given paths.
+	Relabel(label string, paths ...string) error
+
+	// SecurityLabel returns the SELinux context of the given path.
+	SecurityLabel(path string) (string, error)
+
 	// Verify checks to make sure that this driver should function
 	// properly. If there is any indication the driver can't function,
 	// this will return an error.
@@ -52,6 +61,13 @@ type LibvirtDriver struct {
 	LibvirtPath    string
 	LibvirtImgPath string
 
+	// LaunchPrefix is the command the libvirt binary is run through, if
+	// any, e.g. to lower its CPU or I/O priority.
+	LaunchPrefix []string
+	// Cgroup is the cgroup v2 path, relative to /sys/fs/cgroup, the libvirt
+	// process is moved into once started.
+	Cgroup string
+
 	vmCmd   *exec.Cmd
 	vmEndCh <-chan int
 	lock    sync.Mutex
@@ -109,7 +125,13 @@ func (d *LibvirtDriver) Libvirt(libvirtArgs ...string) error {
 	stderr_r, stderr_w := io.Pipe()
 
 	log.Printf("Executing %s: %#v", d.LibvirtPath, libvirtArgs)
-	cmd := exec.Command(d.LibvirtPath, libvirtArgs...)
+	args := append([]string{}, d.LaunchPrefix...)
+	args = append(args, d.LibvirtPath)
+	args = append(args, libvirtArgs...)
+	if len(d.LaunchPrefix) > 0 {
+		log.Printf("Running %s through: %#v", d.LibvirtPath, d.LaunchPrefix)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdout = stdout_w
 	cmd.Stderr = stderr_w
 
@@ -124,8 +146,11 @@ func (d *LibvirtDriver) Libvirt(libvirtArgs ...string) error {
 
 	log.Printf("Started Libvirt. Pid: %d", cmd.Process.Pid)
 
-	// Wait for Libvirt to complete in the background, and mark when its done
+	// Wait for Libvirt to complete in the background, and mark when its done.
+	// doneCh is closed once the VM state is cleared, so any number of callers
+	// can wait for the VM to exit and then run a new one.
 	endCh := make(chan int, 1)
+	doneCh := make(chan int)
 	go func() {
 		defer stderr_w.Close()
 		defer stdout_w.Close()
@@ -145,11 +170,21 @@ func (d *LibvirtDriver) Libvirt(libvirtArgs ...string) error {
 		endCh <- exitCode
 
 		d.lock.Lock()
-		defer d.lock.Unlock()
 		d.vmCmd = nil
 		d.vmEndCh = nil
+		d.lock.Unlock()
+		close(doneCh)
 	}()
 
+	if d.Cgroup != "" {
+		if err := joinCgroup(d.Cgroup, cmd.Process.Pid); err != nil {
+			cmd.Process.Kill()
+			err = fmt.Errorf("Error moving VM into cgroup %s: %s", d.Cgroup, err)
+			return err
+		}
+		log.Printf("Moved Libvirt into cgroup: %s", d.Cgroup)
+	}
+
 	// Wait at least a couple seconds for an early fail from Libvirt so
 	// we can report that.
 	select {
@@ -162,7 +197,7 @@ func (d *LibvirtDriver) Libvirt(libvirtArgs ...string) error {
 
 	// Setup our state so we know we are running
 	d.vmCmd = cmd
-	d.vmEndCh = endCh
+	d.vmEndCh = doneCh
 
 	return nil
 }
@@ -206,6 +241,37 @@ func (d *LibvirtDriver) LibvirtImg(args ...string) error {
 	return err
 }
 
+func (d *LibvirtDriver) Relabel(label string, paths ...string) error {
+	var stderr bytes.Buffer
+
+	args := append([]string{"-R", label}, paths...)
+	log.Printf("Executing chcon: %#v", args)
+	cmd := exec.Command("chcon", args...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	if _, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("chcon error: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	return err
+}
+
+func (d *LibvirtDriver) SecurityLabel(path string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("stat", "-c", "%C", path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	if _, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("stat error: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), err
+}
+
 func (d *LibvirtDriver) Verify() error {
 	return nil
 }
@@ -231,6 +297,11 @@ func (d *LibvirtDriver) Version() (string, error) {
 	return matches[0], nil
 }
 
+func joinCgroup(cgroup string, pid int) error {
+	procs := filepath.Join("/sys/fs/cgroup", cgroup, "cgroup.procs")
+	return os.WriteFile(procs, []byte(strconv.Itoa(pid)), 0644)
+}
+
 func logReader(name string, r io.Reader) {
 	bufR := bufio.NewReader(r)
 	for {
@@ -19,8 +19,18 @@ type DriverMock struct {
 
 	LibvirtImgCalled bool
 	LibvirtImgCalls  []string
+	LibvirtImgCount  int
 	LibvirtImgErrs   []error
 
+	RelabelCalled bool
+	RelabelLabel  string
+	RelabelPaths  []string
+	RelabelErr    error
+
+	SecurityLabelCalled bool
+	SecurityLabelResult string
+	SecurityLabelErr    error
+
 	VerifyCalled bool
 	VerifyErr    error
 
@@ -56,13 +66,26 @@ func (d *DriverMock) WaitForShutdown(cancelCh <-chan struct{}) bool {
 func (d *DriverMock) LibvirtImg(args ...string) error {
 	d.LibvirtImgCalled = true
 	d.LibvirtImgCalls = append(d.LibvirtImgCalls, args...)
+	d.LibvirtImgCount++
 
-	if len(d.LibvirtImgErrs) >= len(d.LibvirtImgCalls) {
-		return d.LibvirtImgErrs[len(d.LibvirtImgCalls)-1]
+	if len(d.LibvirtImgErrs) >= d.LibvirtImgCount {
+		return d.LibvirtImgErrs[d.LibvirtImgCount-1]
 	}
 	return nil
 }
 
+func (d *DriverMock) Relabel(label string, paths ...string) error {
+	d.RelabelCalled = true
+	d.RelabelLabel = label
+	d.RelabelPaths = paths
+	return d.RelabelErr
+}
+
+func (d *DriverMock) SecurityLabel(path string) (string, error) {
+	d.SecurityLabelCalled = true
+	return d.SecurityLabelResult, d.SecurityLabelErr
+}
+
 func (d *DriverMock) Verify() error {
 	d.VerifyCalled = true
 	return d.VerifyErr
@@ -0,0 +1,164 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+const (
+	// guestAgentSyncTimeout bounds how long we wait for the guest agent to
+	// answer at all, which is the only way to tell whether it is running.
+	guestAgentSyncTimeout = 5 * time.Second
+	// guestAgentCommandTimeout bounds commands such as a filesystem freeze,
+	// which may have to flush a lot of dirty data in the guest.
+	guestAgentCommandTimeout = 60 * time.Second
+)
+
+// guestAgent is a minimal client for the guest agent protocol, spoken over
+// the virtio-serial channel attached to the VM when guest_agent_enable is
+// set.
+type guestAgent struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+type guestAgentResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// newGuestAgent connects to the guest agent socket and synchronizes with the
+// agent. It returns an error when the agent doesn't answer, e.g. because it
+// isn't installed or not yet started in the guest.
+func newGuestAgent(socketPath string) (*guestAgent, error) {
+	conn, err := net.DialTimeout("unix", socketPath, guestAgentSyncTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	agent := &guestAgent{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+	}
+	if err := agent.sync(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return agent, nil
+}
+
+// sync discards any stale data left in the channel by a previous client, as
+// recommended by the guest agent protocol.
+func (a *guestAgent) sync() error {
+	id := time.Now().UnixNano()
+	if err := a.send("guest-sync", map[string]interface{}{"id": id}, guestAgentSyncTimeout); err != nil {
+		return err
+	}
+
+	for {
+		var resp guestAgentResponse
+		if err := a.dec.Decode(&resp); err != nil {
+			return err
+		}
+
+		var got int64
+		if err := json.Unmarshal(resp.Return, &got); err == nil && got == id {
+			return nil
+		}
+	}
+}
+
+func (a *guestAgent) send(command string, arguments interface{}, timeout time.Duration) error {
+	req := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		req["arguments"] = arguments
+	}
+
+	if err := a.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	return json.NewEncoder(a.conn).Encode(req)
+}
+
+// run executes a guest agent command and returns its raw result.
+func (a *guestAgent) run(command string) (json.RawMessage, error) {
+	log.Printf("Executing guest agent command: %s", command)
+	if err := a.send(command, nil, guestAgentCommandTimeout); err != nil {
+		return nil, err
+	}
+
+	var resp guestAgentResponse
+	if err := a.dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("%s: %s", resp.Error.Class, resp.Error.Desc)
+	}
+
+	return resp.Return, nil
+}
+
+// Freeze freezes all the guest filesystems that support it.
+func (a *guestAgent) Freeze() error {
+	_, err := a.run("guest-fsfreeze-freeze")
+	return err
+}
+
+// Thaw thaws the guest filesystems frozen with Freeze.
+func (a *guestAgent) Thaw() error {
+	_, err := a.run("guest-fsfreeze-thaw")
+	return err
+}
+
+func (a *guestAgent) Close() error {
+	return a.conn.Close()
+}
+
+// freezeGuestFilesystems freezes the guest filesystems when a guest agent is
+// available at socketPath. It returns the connected agent so the caller can
+// thaw them again, or nil when nothing was frozen.
+func freezeGuestFilesystems(ui packersdk.Ui, socketPath string) *guestAgent {
+	if socketPath == "" {
+		return nil
+	}
+
+	agent, err := newGuestAgent(socketPath)
+	if err != nil {
+		log.Printf("Guest agent is not available: %s", err)
+		ui.Message("Guest agent is not available; skipping filesystem freeze.")
+		return nil
+	}
+
+	ui.Say("Freezing guest filesystems...")
+	if err := agent.Freeze(); err != nil {
+		ui.Error(fmt.Sprintf("Error freezing guest filesystems: %s", err))
+		agent.Close()
+		return nil
+	}
+
+	return agent
+}
+
+// thawGuestFilesystems thaws the filesystems frozen by freezeGuestFilesystems
+// and closes the agent connection.
+func thawGuestFilesystems(ui packersdk.Ui, agent *guestAgent) {
+	if agent == nil {
+		return
+	}
+	defer agent.Close()
+
+	ui.Say("Thawing guest filesystems...")
+	if err := agent.Thaw(); err != nil {
+		ui.Error(fmt.Sprintf("Error thawing guest filesystems: %s", err))
+	}
+}
@@ -0,0 +1,104 @@
+package libvirt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGuestAgent serves the guest agent protocol on a unix socket and
+// records the commands it receives.
+func fakeGuestAgent(t *testing.T) (string, <-chan string) {
+	socketPath := filepath.Join(t.TempDir(), "agent")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", socketPath, err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	commands := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Simulate a stale response left by a previous client.
+		fmt.Fprintln(conn, `{"return": 0}`)
+
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			var req struct {
+				Execute   string `json:"execute"`
+				Arguments struct {
+					ID int64 `json:"id"`
+				} `json:"arguments"`
+			}
+			if err := json.Unmarshal(s.Bytes(), &req); err != nil {
+				return
+			}
+			commands <- req.Execute
+
+			switch req.Execute {
+			case "guest-sync":
+				fmt.Fprintf(conn, "{\"return\": %d}\n", req.Arguments.ID)
+			case "guest-fsfreeze-freeze", "guest-fsfreeze-thaw":
+				fmt.Fprintln(conn, `{"return": 1}`)
+			default:
+				fmt.Fprintln(conn, `{"error": {"class": "CommandNotFound", "desc": "not found"}}`)
+			}
+		}
+	}()
+
+	return socketPath, commands
+}
+
+func Test_GuestAgentFreezeThaw(t *testing.T) {
+	socketPath, commands := fakeGuestAgent(t)
+	ui := packersdk.TestUi(t)
+
+	agent := freezeGuestFilesystems(ui, socketPath)
+	if agent == nil {
+		t.Fatalf("should have frozen the guest filesystems")
+	}
+	thawGuestFilesystems(ui, agent)
+
+	expected := []string{"guest-sync", "guest-fsfreeze-freeze", "guest-fsfreeze-thaw"}
+	for _, command := range expected {
+		assert.Equal(t, command, <-commands, "Unexpected guest agent command")
+	}
+}
+
+func Test_GuestAgentCommandError(t *testing.T) {
+	socketPath, _ := fakeGuestAgent(t)
+
+	agent, err := newGuestAgent(socketPath)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	defer agent.Close()
+
+	if _, err := agent.run("guest-unknown"); err == nil {
+		t.Fatalf("should have error for an unknown command")
+	}
+}
+
+func Test_GuestAgentUnavailable(t *testing.T) {
+	ui := packersdk.TestUi(t)
+
+	if agent := freezeGuestFilesystems(ui, ""); agent != nil {
+		t.Fatalf("should not freeze without a guest agent socket")
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "missing")
+	if agent := freezeGuestFilesystems(ui, socketPath); agent != nil {
+		t.Fatalf("should not freeze when the guest agent socket doesn't exist")
+	}
+}
@@ -0,0 +1,131 @@
+package libvirt
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/digitalocean/go-qemu/qmp"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step pauses the running VM, copies its disks and resumes it, so a
+// consistent capture of the disks can be taken without shutting it down.
+// When a guest agent is available, the guest filesystems are frozen for the
+// duration of the capture as well.
+//
+// Uses:
+//   driver             Driver
+//   libvirt_disk_paths []string
+//   qmp_monitor        *qmp.SocketMonitor
+//   ui                 packersdk.Ui
+//
+// Produces:
+//   libvirt_capture_paths []string - The paths of the captured disks.
+type stepCaptureDisk struct {
+	CaptureName          string
+	Format               string
+	GuestAgentSocketPath string
+	OutputDir            string
+
+	// pauser pauses the VM during the capture. Defaults to pausing it
+	// through qmp_monitor.
+	pauser vmPauser
+}
+
+func (s *stepCaptureDisk) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	if s.CaptureName == "" {
+		return multistep.ActionContinue
+	}
+
+	pauser := s.pauser
+	if pauser == nil {
+		pauser = &qmpPauser{monitor: state.Get("qmp_monitor").(*qmp.SocketMonitor)}
+	}
+	diskFullPaths := state.Get("libvirt_disk_paths").([]string)
+
+	agent := freezeGuestFilesystems(ui, s.GuestAgentSocketPath)
+	defer thawGuestFilesystems(ui, agent)
+
+	ui.Say("Pausing virtual machine to capture disks...")
+	if err := pauser.Pause(); err != nil {
+		err := fmt.Errorf("Error pausing VM: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	capturePaths, err := s.captureDisks(driver, diskFullPaths)
+
+	log.Println("Resuming virtual machine after disk capture")
+	if err := pauser.Resume(); err != nil {
+		err := fmt.Errorf("Error resuming VM: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if err != nil {
+		err := fmt.Errorf("Error capturing hard drive: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("libvirt_capture_paths", capturePaths)
+
+	return multistep.ActionContinue
+}
+
+func (s *stepCaptureDisk) captureDisks(driver Driver, diskFullPaths []string) ([]string, error) {
+	capturePaths := make([]string, 0, len(diskFullPaths))
+	for i, diskFullPath := range diskFullPaths {
+		name := s.CaptureName
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d", s.CaptureName, i)
+		}
+		capturePath := filepath.Join(s.OutputDir, name)
+
+		// Converting keeps the capture sparse and standalone. The disk is
+		// still opened by the paused VM, so its lock has to be shared.
+		log.Printf("[INFO] Capturing disk %s to %s", diskFullPath, capturePath)
+		command := []string{"convert", "-U", "-f", s.Format, "-O", s.Format, diskFullPath, capturePath}
+		if err := driver.LibvirtImg(command...); err != nil {
+			return nil, err
+		}
+		capturePaths = append(capturePaths, capturePath)
+	}
+
+	return capturePaths, nil
+}
+
+func (s *stepCaptureDisk) Cleanup(state multistep.StateBag) {}
+
+// vmPauser pauses and resumes the execution of a running VM.
+type vmPauser interface {
+	Pause() error
+	Resume() error
+}
+
+// qmpPauser pauses the VM through its QMP monitor.
+type qmpPauser struct {
+	monitor *qmp.SocketMonitor
+}
+
+// Pause stops the execution of the guest vCPUs. Pending guest I/O is drained
+// before the command returns.
+func (p *qmpPauser) Pause() error {
+	_, err := p.monitor.Run([]byte(`{"execute":"stop"}`))
+	return err
+}
+
+// Resume resumes the execution of a guest paused with Pause.
+func (p *qmpPauser) Resume() error {
+	_, err := p.monitor.Run([]byte(`{"execute":"cont"}`))
+	return err
+}
@@ -0,0 +1,119 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/stretchr/testify/assert"
+)
+
+// pauserMock records the pause and resume requests of a capture.
+type pauserMock struct {
+	Calls []string
+}
+
+func (p *pauserMock) Pause() error {
+	p.Calls = append(p.Calls, "pause")
+	return nil
+}
+
+func (p *pauserMock) Resume() error {
+	p.Calls = append(p.Calls, "resume")
+	return nil
+}
+
+func Test_StepCaptureSkip(t *testing.T) {
+	step := stepCaptureDisk{}
+
+	d := new(DriverMock)
+	state := copyTestState(t, d)
+	action := step.Run(context.TODO(), state)
+	if action != multistep.ActionContinue {
+		t.Fatalf("Should have gotten an ActionContinue")
+	}
+
+	if d.LibvirtImgCalled {
+		t.Fatalf("Should have skipped step since CaptureName is not set")
+	}
+}
+
+func Test_StepCaptureDisks(t *testing.T) {
+	step := stepCaptureDisk{
+		CaptureName: "capture",
+		Format:      "qcow2",
+		OutputDir:   "output",
+	}
+
+	d := new(DriverMock)
+	capturePaths, err := step.captureDisks(d, []string{
+		filepath.Join("output", "disk"),
+		filepath.Join("output", "disk-1"),
+	})
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if !d.LibvirtImgCalled {
+		t.Fatalf("Should have called libvirt-img through the driver")
+	}
+
+	expected := []string{
+		filepath.Join("output", "capture"),
+		filepath.Join("output", "capture-1"),
+	}
+	assert.Equal(t, expected, capturePaths, "Capture paths don't match")
+}
+
+func Test_StepCaptureRun(t *testing.T) {
+	pauser := new(pauserMock)
+	step := stepCaptureDisk{
+		CaptureName: "capture",
+		Format:      "raw",
+		OutputDir:   "output",
+		pauser:      pauser,
+	}
+
+	d := new(DriverMock)
+	state := copyTestState(t, d)
+	state.Put("libvirt_disk_paths", []string{filepath.Join("output", "disk")})
+	action := step.Run(context.TODO(), state)
+	if action != multistep.ActionContinue {
+		t.Fatalf("Should have gotten an ActionContinue")
+	}
+
+	assert.Equal(
+		t,
+		[]string{"convert", "-U", "-f", "raw", "-O", "raw",
+			filepath.Join("output", "disk"), filepath.Join("output", "capture")},
+		d.LibvirtImgCalls,
+		"Should have captured the disk with a sparse conversion")
+	assert.Equal(t, []string{"pause", "resume"}, pauser.Calls, "Should have paused the VM during the capture")
+	assert.Equal(t, []string{filepath.Join("output", "capture")}, state.Get("libvirt_capture_paths"))
+}
+
+func Test_StepCaptureCopyError(t *testing.T) {
+	pauser := new(pauserMock)
+	step := stepCaptureDisk{
+		CaptureName: "capture",
+		Format:      "raw",
+		OutputDir:   "output",
+		pauser:      pauser,
+	}
+
+	d := new(DriverMock)
+	d.LibvirtImgErrs = []error{errors.New("convert failed")}
+	state := copyTestState(t, d)
+	state.Put("libvirt_disk_paths", []string{filepath.Join("output", "disk")})
+	action := step.Run(context.TODO(), state)
+	if action != multistep.ActionHalt {
+		t.Fatalf("Should have gotten an ActionHalt")
+	}
+
+	assert.Equal(t, []string{"pause", "resume"}, pauser.Calls, "Should have resumed the VM after the failed capture")
+	if _, ok := state.GetOk("libvirt_capture_paths"); ok {
+		t.Fatalf("Should not have produced capture paths")
+	}
+}
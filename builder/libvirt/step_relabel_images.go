@@ -0,0 +1,92 @@
+package libvirt
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step relabels the output directory and the images attached to the VM
+// so the libvirt process is allowed to access them on SELinux hosts. The
+// attached images may be user files or shared with other builds, so their
+// original labels are restored on cleanup.
+//
+// Uses:
+//   cd_path     string
+//   driver      Driver
+//   floppy_path string
+//   iso_path    string
+//   ui          packersdk.Ui
+//
+// Produces:
+//   <nothing>
+type stepRelabelImages struct {
+	ImageLabel string
+	OutputDir  string
+	Relabel    bool
+
+	// labels holds the original labels of the attached images.
+	labels map[string]string
+}
+
+func (s *stepRelabelImages) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	if !s.Relabel {
+		return multistep.ActionContinue
+	}
+
+	// The disks live in the output directory; the attached media may live
+	// anywhere. The ISO may also be a remote URL when iso_skip_cache is set.
+	paths := []string{s.OutputDir}
+	s.labels = make(map[string]string)
+	for _, key := range []string{"iso_path", "floppy_path", "cd_path"} {
+		path, ok := state.Get(key).(string)
+		if !ok || path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		label, err := driver.SecurityLabel(path)
+		if err != nil {
+			err := fmt.Errorf("Error reading the label of %s: %s", path, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		s.labels[path] = label
+		paths = append(paths, path)
+	}
+
+	ui.Say(fmt.Sprintf("Relabeling images with %s...", s.ImageLabel))
+	if err := driver.Relabel(s.ImageLabel, paths...); err != nil {
+		err := fmt.Errorf("Error relabeling images: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *stepRelabelImages) Cleanup(state multistep.StateBag) {
+	if len(s.labels) == 0 {
+		return
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	ui.Say("Restoring the labels of the attached images...")
+	for path, label := range s.labels {
+		if err := driver.Relabel(label, path); err != nil {
+			ui.Error(fmt.Sprintf("Error restoring the label of %s: %s", path, err))
+		}
+	}
+}
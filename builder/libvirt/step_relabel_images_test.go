@@ -0,0 +1,67 @@
+package libvirt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_StepRelabelSkip(t *testing.T) {
+	step := stepRelabelImages{
+		ImageLabel: "system_u:object_r:svirt_image_t:s0",
+		OutputDir:  "output",
+	}
+
+	d := new(DriverMock)
+	state := copyTestState(t, d)
+	action := step.Run(context.TODO(), state)
+	if action != multistep.ActionContinue {
+		t.Fatalf("Should have gotten an ActionContinue")
+	}
+
+	if d.RelabelCalled {
+		t.Fatalf("Should have skipped step since Relabel is not set")
+	}
+}
+
+func Test_StepRelabelCalled(t *testing.T) {
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tf.Close()
+	defer os.Remove(tf.Name())
+
+	step := stepRelabelImages{
+		ImageLabel: "system_u:object_r:svirt_image_t:s0",
+		OutputDir:  "output",
+		Relabel:    true,
+	}
+
+	d := new(DriverMock)
+	d.SecurityLabelResult = "unconfined_u:object_r:user_tmp_t:s0"
+	state := copyTestState(t, d)
+	state.Put("floppy_path", tf.Name())
+	action := step.Run(context.TODO(), state)
+	if action != multistep.ActionContinue {
+		t.Fatalf("Should have gotten an ActionContinue")
+	}
+
+	if !d.RelabelCalled {
+		t.Fatalf("Should have called Relabel through the driver")
+	}
+
+	assert.Equal(t, "system_u:object_r:svirt_image_t:s0", d.RelabelLabel, "Bad image label")
+	// The ISO doesn't exist, it should be skipped
+	assert.Equal(t, []string{"output", tf.Name()}, d.RelabelPaths, "Bad relabeled paths")
+
+	// The original label of the floppy should be restored, while the output
+	// directory keeps the image label
+	step.Cleanup(state)
+	assert.Equal(t, "unconfined_u:object_r:user_tmp_t:s0", d.RelabelLabel, "Bad restored label")
+	assert.Equal(t, []string{tf.Name()}, d.RelabelPaths, "Bad restored paths")
+}
@@ -104,6 +104,11 @@ func (s *stepRun) getDefaultArgs(config *Config, state multistep.StateBag) map[s
 			config.MachineType, config.Accelerator)
 	}
 
+	// Configure "-cpu" arguments for the Hyper-V enlightenments
+	if len(config.HypervFeatures) > 0 {
+		defaultArgs["-cpu"] = "host" + hypervCPUFlags(config.HypervFeatures)
+	}
+
 	// Firmware
 	if config.Firmware != "" {
 		defaultArgs["-bios"] = config.Firmware
@@ -249,6 +254,11 @@ func (s *stepRun) getDeviceAndDriveArgs(config *Config, state multistep.StateBag
 
 	deviceArgs = append(deviceArgs, fmt.Sprintf("%s,netdev=user.0", config.NetDevice))
 
+	// Configure the guest agent channel
+	if config.GuestAgentEnable {
+		deviceArgs = append(deviceArgs, "virtio-serial", "virtserialport,chardev=agent0,name=org.qemu.guest_agent.0")
+	}
+
 	// Configure virtual CDs
 	cdPaths := []string{}
 	// Add the installation CD to the run command
@@ -335,6 +345,8 @@ func (s *stepRun) applyUserOverrides(defaultArgs map[string]interface{}, config
 		}
 	}
 
+	_, userCPU := inArgs["-cpu"]
+
 	// get any remaining missing default args from the default settings
 	for key := range defaultArgs {
 		if _, ok := inArgs[key]; !ok {
@@ -356,6 +368,22 @@ func (s *stepRun) applyUserOverrides(defaultArgs map[string]interface{}, config
 		}
 	}
 
+	// Add the Hyper-V enlightenments to the user provided cpu model
+	if userCPU && len(config.HypervFeatures) > 0 {
+		for i := range inArgs["-cpu"] {
+			inArgs["-cpu"][i] += hypervCPUFlags(config.HypervFeatures)
+		}
+	}
+
+	// Add the guest agent channel next to any user provided chardev, and its
+	// port if the user provided devices don't include it
+	if config.GuestAgentEnable {
+		inArgs["-chardev"] = append(inArgs["-chardev"], fmt.Sprintf("socket,path=%s,server,nowait,id=agent0", config.GuestAgentSocketPath))
+		if !strings.Contains(strings.Join(inArgs["-device"], ""), "chardev=agent0") {
+			inArgs["-device"] = append(inArgs["-device"], "virtio-serial", "virtserialport,chardev=agent0,name=org.qemu.guest_agent.0")
+		}
+	}
+
 	// Flatten to array of strings
 	outArgs := make([]string, 0)
 	for key, values := range inArgs {
@@ -377,6 +405,17 @@ func (s *stepRun) getCommandArgs(config *Config, state multistep.StateBag) ([]st
 	return s.applyUserOverrides(defaultArgs, config, state)
 }
 
+// hypervCPUFlags returns the cpu flags enabling the given Hyper-V
+// enlightenments, to be appended to a cpu model.
+func hypervCPUFlags(features []string) string {
+	var flags string
+	for _, feature := range features {
+		flags += ",hv_" + feature
+	}
+
+	return flags
+}
+
 func processArgs(args [][]string, ctx *interpolate.Context) ([][]string, error) {
 	var err error
 
@@ -85,6 +85,41 @@ func Test_UserOverrides(t *testing.T) {
 			},
 			"Net device gets added",
 		},
+		{
+			&Config{
+				VMName:               "myvm",
+				GuestAgentEnable:     true,
+				GuestAgentSocketPath: "/path/to/agent",
+				LibvirtArgs: [][]string{
+					{"-chardev", "socket,path=/path/to/serial,server,nowait,id=serial0"},
+					{"-device", "somerandomdevice"},
+				},
+			},
+			[]string{
+				"-display", "gtk",
+				"-chardev", "socket,path=/path/to/serial,server,nowait,id=serial0",
+				"-chardev", "socket,path=/path/to/agent,server,nowait,id=agent0",
+				"-device", "somerandomdevice",
+				"-device", "virtio-serial",
+				"-device", "virtserialport,chardev=agent0,name=org.qemu.guest_agent.0",
+				"-drive", "file=/path/to/test.iso,media=cdrom",
+			},
+			"Guest agent channel is kept next to user chardevs",
+		},
+		{
+			&Config{
+				VMName:         "myvm",
+				HypervFeatures: []string{"relaxed", "spinlocks=8191"},
+				LibvirtArgs:    [][]string{{"-cpu", "Skylake-Client"}},
+			},
+			[]string{
+				"-display", "gtk",
+				"-cpu", "Skylake-Client,hv_relaxed,hv_spinlocks=8191",
+				"-drive", "file=/path/to/test.iso,media=cdrom",
+				"-device", ",netdev=user.0",
+			},
+			"Hyper-V enlightenments are added to the user cpu model",
+		},
 	}
 
 	for _, tc := range testcases {
@@ -511,6 +546,25 @@ func Test_Defaults(t *testing.T) {
 			[]string{"-qmp", "unix:,server,nowait"},
 			"Args contain -qmp even when socket path isn't set, if qmp enabled",
 		},
+		{
+			&Config{
+				GuestAgentEnable:     true,
+				GuestAgentSocketPath: "/path/to/agent",
+			},
+			map[string]interface{}{},
+			&stepRun{ui: packersdk.TestUi(t)},
+			[]string{"-chardev", "socket,path=/path/to/agent,server,nowait,id=agent0"},
+			"Args should contain -chardev when guest_agent_enable is set",
+		},
+		{
+			&Config{
+				GuestAgentEnable: true,
+			},
+			map[string]interface{}{},
+			&stepRun{ui: packersdk.TestUi(t)},
+			[]string{"-device", "virtserialport,chardev=agent0,name=org.qemu.guest_agent.0"},
+			"Args should contain the guest agent port when guest_agent_enable is set",
+		},
 		{
 			&Config{
 				VMName: "partyname",
@@ -548,6 +602,16 @@ func Test_Defaults(t *testing.T) {
 			[]string{"-machine", "type=fancymachine,accel=kvm"},
 			"Add accelerator tag when accelerator is set.",
 		},
+		{
+			&Config{
+				Accelerator:    "kvm",
+				HypervFeatures: []string{"relaxed", "vapic", "spinlocks=8191"},
+			},
+			map[string]interface{}{},
+			&stepRun{ui: packersdk.TestUi(t)},
+			[]string{"-cpu", "host,hv_relaxed,hv_vapic,hv_spinlocks=8191"},
+			"Add Hyper-V enlightenments to the host CPU model when set.",
+		},
 		{
 			&Config{
 				NetBridge: "fakebridge",
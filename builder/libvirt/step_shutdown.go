@@ -13,7 +13,9 @@ import (
 )
 
 // This step shuts down the machine. It first attempts to do so gracefully,
-// but ultimately forcefully shuts it down if that fails.
+// but ultimately forcefully shuts it down if that fails. Before a forceful
+// shut down, the guest filesystems are frozen when a guest agent is
+// available.
 //
 // Uses:
 //   communicator packersdk.Communicator
@@ -24,9 +26,10 @@ import (
 // Produces:
 //   <nothing>
 type stepShutdown struct {
-	ShutdownCommand string
-	ShutdownTimeout time.Duration
-	Comm            *communicator.Config
+	ShutdownCommand      string
+	ShutdownTimeout      time.Duration
+	Comm                 *communicator.Config
+	GuestAgentSocketPath string
 }
 
 func (s *stepShutdown) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -78,13 +81,21 @@ func (s *stepShutdown) Run(ctx context.Context, state multistep.StateBag) multis
 			return multistep.ActionHalt
 		}
 	} else {
+		// The filesystems are left frozen on purpose, the VM is killed
+		// right away. They are only thawed if it keeps running.
+		agent := freezeGuestFilesystems(ui, s.GuestAgentSocketPath)
+
 		ui.Say("Halting the virtual machine...")
 		if err := driver.Stop(); err != nil {
+			thawGuestFilesystems(ui, agent)
 			err := fmt.Errorf("Error stopping VM: %s", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
+		if agent != nil {
+			agent.Close()
+		}
 	}
 
 	log.Println("VM shut down.")
@@ -2,12 +2,14 @@ package libvirt
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/communicator"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/stretchr/testify/assert"
 )
 
 func Test_Shutdown_Null_success(t *testing.T) {
@@ -86,3 +88,49 @@ func Test_Shutdown_NoShutdownCommand(t *testing.T) {
 		t.Fatalf("Shutdown shouldn't have errored; err: %v", err)
 	}
 }
+
+func Test_Shutdown_GuestAgentFreeze(t *testing.T) {
+	testcases := []struct {
+		ShutdownCommand string
+		StopErr         error
+		Expected        []string
+	}{
+		// The VM is killed, so the filesystems are frozen first
+		{"", nil, []string{"guest-sync", "guest-fsfreeze-freeze"}},
+		// The VM keeps running, so the filesystems are thawed again
+		{"", errors.New("stop failed"), []string{"guest-sync", "guest-fsfreeze-freeze", "guest-fsfreeze-thaw"}},
+		// The guest shuts down cleanly on its own
+		{"shutdown -P now", nil, []string{}},
+	}
+
+	for _, tc := range testcases {
+		socketPath, commands := fakeGuestAgent(t)
+
+		state := new(multistep.BasicStateBag)
+		state.Put("ui", packersdk.TestUi(t))
+		state.Put("communicator", new(packersdk.MockCommunicator))
+		driverMock := new(DriverMock)
+		driverMock.StopErr = tc.StopErr
+		driverMock.WaitForShutdownState = true
+		state.Put("driver", driverMock)
+
+		step := &stepShutdown{
+			ShutdownCommand:      tc.ShutdownCommand,
+			ShutdownTimeout:      5 * time.Minute,
+			Comm:                 &communicator.Config{Type: "ssh"},
+			GuestAgentSocketPath: socketPath,
+		}
+		step.Run(context.TODO(), state)
+
+		received := []string{}
+		for done := false; !done; {
+			select {
+			case command := <-commands:
+				received = append(received, command)
+			default:
+				done = true
+			}
+		}
+		assert.Equal(t, tc.Expected, received, "Unexpected guest agent commands for %q", tc.ShutdownCommand)
+	}
+}
@@ -0,0 +1,316 @@
+package libvirt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/retry"
+)
+
+// verifyBootStopTimeout bounds how long we wait for a VM to exit once killed.
+const verifyBootStopTimeout = 30 * time.Second
+
+// This step boots a throwaway overlay of the finalized disks and waits for
+// the guest to come up, to make sure the resulting image actually boots.
+//
+// Uses:
+//   commHostPort       int
+//   config             *config
+//   driver             Driver
+//   libvirt_disk_paths []string
+//   ui                 packersdk.Ui
+//
+// Produces:
+//   <nothing>
+type stepVerifyBoot struct {
+	VerifyBoot bool
+	Timeout    time.Duration
+
+	tmpDir string
+}
+
+// verifyDriveArgs are the libvirtargs switches attaching drives, which are
+// dropped so the verification VM only boots the overlays.
+var verifyDriveArgs = map[string]bool{
+	"-cdrom": true,
+	"-drive": true,
+	"-hda":   true,
+	"-hdb":   true,
+	"-hdc":   true,
+	"-hdd":   true,
+}
+
+// verifyStateKeys are the state keys the verification VM is configured from,
+// on top of the ones set by this step.
+var verifyStateKeys = []string{
+	"commHostPort",
+	"http_ip",
+	"http_port",
+	"vnc_password",
+	"vnc_port",
+}
+
+func (s *stepVerifyBoot) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	if !s.VerifyBoot {
+		return multistep.ActionContinue
+	}
+
+	ui.Say("Verifying that the image boots...")
+
+	// The build VM may still be exiting when it was halted without a
+	// shutdown_command, and holds on to the disks until it does.
+	if !stopAndWait(driver) {
+		err := fmt.Errorf("Timeout waiting for the build VM to exit")
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	// The overlays are created in the output directory, which the libvirt
+	// process is allowed to access on hardened hosts.
+	var err error
+	s.tmpDir, err = ioutil.TempDir(config.OutputDir, "verify-boot")
+	if err != nil {
+		err := fmt.Errorf("Error creating temporary directory: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	// Retry a few times in case it takes the libvirt process a moment to
+	// release the lock on the disks
+	var overlayPaths []string
+	err = retry.Config{
+		Tries: 10,
+		ShouldRetry: func(err error) bool {
+			if strings.Contains(err.Error(), `Failed to get shared "write" lock`) {
+				ui.Say("Error getting file lock for verification overlay; retrying...")
+				return true
+			}
+			return false
+		},
+		RetryDelay: (&retry.Backoff{InitialBackoff: 1 * time.Second, MaxBackoff: 10 * time.Second, Multiplier: 2}).Linear,
+	}.Run(ctx, func(ctx context.Context) error {
+		overlayPaths, err = s.createOverlays(driver, config.Format, state.Get("libvirt_disk_paths").([]string))
+		return err
+	})
+	if err != nil {
+		err := fmt.Errorf("Error creating verification overlay: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if config.SecLabelRelabel {
+		if err := driver.Relabel(config.SecLabelImageLabel, s.tmpDir); err != nil {
+			err := fmt.Errorf("Error relabeling verification overlay: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	verifyConfig := s.verifyConfig(config)
+	verifyState := new(multistep.BasicStateBag)
+	for _, key := range verifyStateKeys {
+		if v, ok := state.GetOk(key); ok {
+			verifyState.Put(key, v)
+		}
+	}
+	verifyState.Put("config", verifyConfig)
+	verifyState.Put("driver", driver)
+	verifyState.Put("ui", ui)
+	verifyState.Put("libvirt_disk_paths", overlayPaths)
+
+	run := &stepRun{DiskImage: true}
+	if action := run.Run(ctx, verifyState); action != multistep.ActionContinue {
+		err := fmt.Errorf("Error launching verification VM")
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+	defer func() {
+		if !stopAndWait(driver) {
+			log.Printf("Timeout waiting for the verification VM to exit")
+		}
+	}()
+
+	ui.Say(fmt.Sprintf("Waiting max %s for the verification VM to boot...", s.Timeout))
+	if err := s.waitForBoot(ctx, verifyConfig, verifyState); err != nil {
+		err := fmt.Errorf("Error verifying that the image boots: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say("Verification VM booted successfully.")
+	return multistep.ActionContinue
+}
+
+func (s *stepVerifyBoot) Cleanup(state multistep.StateBag) {
+	if s.tmpDir != "" {
+		if err := os.RemoveAll(s.tmpDir); err != nil {
+			log.Printf("failed to remove verification overlays: %v", err)
+		}
+	}
+}
+
+// createOverlays creates a qcow2 overlay backed by each disk, so booting the
+// verification VM leaves the disks untouched.
+func (s *stepVerifyBoot) createOverlays(driver Driver, format string, diskFullPaths []string) ([]string, error) {
+	overlayPaths := make([]string, 0, len(diskFullPaths))
+	for _, diskFullPath := range diskFullPaths {
+		// Backing file paths are relative to the overlay
+		backingPath, err := filepath.Abs(diskFullPath)
+		if err != nil {
+			return nil, err
+		}
+		overlayPath := filepath.Join(s.tmpDir, filepath.Base(diskFullPath))
+
+		command := []string{"create", "-f", "qcow2", "-b", backingPath, "-F", format, overlayPath}
+		if err := driver.LibvirtImg(command...); err != nil {
+			return nil, err
+		}
+		overlayPaths = append(overlayPaths, overlayPath)
+	}
+
+	return overlayPaths, nil
+}
+
+// verifyConfig returns the configuration of the verification VM: the build
+// VM one, booting the overlays without any installation media. User provided
+// drives are dropped, as they would point at the disks themselves.
+func (s *stepVerifyBoot) verifyConfig(config *Config) *Config {
+	verifyConfig := *config
+	verifyConfig.DiskImage = true
+	verifyConfig.Format = "qcow2"
+	verifyConfig.QMPEnable = false
+	verifyConfig.LibvirtArgs = make([][]string, 0, len(config.LibvirtArgs))
+	for _, args := range config.LibvirtArgs {
+		if len(args) > 0 && verifyDriveArgs[args[0]] {
+			log.Printf("Dropping %s from the verification VM arguments", args[0])
+			continue
+		}
+		verifyConfig.LibvirtArgs = append(verifyConfig.LibvirtArgs, args)
+	}
+	if verifyConfig.GuestAgentEnable {
+		verifyConfig.GuestAgentSocketPath = filepath.Join(s.tmpDir, "agent")
+	}
+
+	return &verifyConfig
+}
+
+func (s *stepVerifyBoot) waitForBoot(ctx context.Context, config *Config, state multistep.StateBag) error {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	for {
+		if s.booted(config, state) {
+			return nil
+		}
+
+		select {
+		case <-time.After(5 * time.Second):
+			continue
+		case <-ctx.Done():
+			return fmt.Errorf("Timeout waiting for the guest to come up")
+		}
+	}
+}
+
+func (s *stepVerifyBoot) booted(config *Config, state multistep.StateBag) bool {
+	if config.GuestAgentEnable {
+		agent, err := newGuestAgent(config.GuestAgentSocketPath)
+		if err != nil {
+			log.Printf("Guest agent is not ready yet: %s", err)
+			return false
+		}
+		agent.Close()
+		return true
+	}
+
+	host, _ := commHost(config.CommConfig.Comm.Host())(state)
+	port, _ := commPort(state)
+	address := net.JoinHostPort(host, fmt.Sprintf("%d", port))
+
+	if config.CommConfig.Comm.Type == "winrm" {
+		return winRMReady(address, config.CommConfig.Comm.WinRMUseSSL)
+	}
+	return sshReady(address)
+}
+
+// stopAndWait kills the running VM, if any, and reports whether it exited
+// in time for a new one to be run.
+func stopAndWait(driver Driver) bool {
+	if err := driver.Stop(); err != nil {
+		log.Printf("failed to stop VM: %v", err)
+	}
+
+	cancelCh := make(chan struct{}, 1)
+	go func() {
+		defer close(cancelCh)
+		<-time.After(verifyBootStopTimeout)
+	}()
+	return driver.WaitForShutdown(cancelCh)
+}
+
+// sshReady reports whether an SSH server answers at address. Since port
+// forwarding accepts connections before the guest is up, the SSH banner is
+// read to tell whether the guest answered.
+func sshReady(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		log.Printf("SSH is not ready yet: %s", err)
+		return false
+	}
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return false
+	}
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		log.Printf("SSH is not ready yet: %s", err)
+		return false
+	}
+
+	return strings.HasPrefix(banner, "SSH-")
+}
+
+// winRMReady reports whether a WinRM service answers at address.
+func winRMReady(address string, useSSL bool) bool {
+	scheme := "http"
+	if useSSL {
+		scheme = "https"
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get(fmt.Sprintf("%s://%s/wsman", scheme, address))
+	if err != nil {
+		log.Printf("WinRM is not ready yet: %s", err)
+		return false
+	}
+	resp.Body.Close()
+
+	return true
+}
@@ -0,0 +1,197 @@
+package libvirt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSSHServer answers every connection with the given banner, and returns
+// the port it listens on.
+func fakeSSHServer(t *testing.T, banner string) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprint(conn, banner)
+			conn.Close()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func verifyTestState(t *testing.T, d *DriverMock, config *Config) multistep.StateBag {
+	state := copyTestState(t, d)
+	state.Put("config", config)
+	state.Put("commHostPort", fakeSSHServer(t, "SSH-2.0-OpenSSH_8.9\r\n"))
+	state.Put("libvirt_disk_paths", []string{filepath.Join(config.OutputDir, "myvm")})
+	state.Put("vnc_port", 5905)
+
+	return state
+}
+
+func Test_StepVerifyBootSkip(t *testing.T) {
+	step := &stepVerifyBoot{}
+
+	d := new(DriverMock)
+	state := copyTestState(t, d)
+	state.Put("config", &Config{})
+	action := step.Run(context.TODO(), state)
+	if action != multistep.ActionContinue {
+		t.Fatalf("Should have gotten an ActionContinue")
+	}
+
+	if d.LibvirtImgCalled || len(d.LibvirtCalls) > 0 {
+		t.Fatalf("Should have skipped step since VerifyBoot is not set")
+	}
+}
+
+func Test_StepVerifyBootRun(t *testing.T) {
+	step := &stepVerifyBoot{
+		VerifyBoot: true,
+		Timeout:    verifyBootStopTimeout,
+	}
+	config := &Config{
+		Format:    "raw",
+		OutputDir: t.TempDir(),
+		VMName:    "myvm",
+	}
+
+	d := new(DriverMock)
+	d.VersionResult = "3.0.0"
+	d.WaitForShutdownState = true
+	state := verifyTestState(t, d, config)
+	action := step.Run(context.TODO(), state)
+	if action != multistep.ActionContinue {
+		t.Fatalf("Should have gotten an ActionContinue: %s", state.Get("error"))
+	}
+
+	if !d.StopCalled || !d.WaitForShutdownCalled {
+		t.Fatalf("Should have waited for the VMs to exit")
+	}
+	if len(d.LibvirtCalls) != 1 {
+		t.Fatalf("Should have launched the verification VM once, got %d", len(d.LibvirtCalls))
+	}
+
+	// The overlay lives in the output directory and backs onto the disk
+	overlayPath := filepath.Join(step.tmpDir, "myvm")
+	if filepath.Dir(step.tmpDir) != config.OutputDir {
+		t.Fatalf("Overlays should be created in the output directory: %s", step.tmpDir)
+	}
+	assert.Equal(
+		t,
+		[]string{"create", "-f", "qcow2", "-b", filepath.Join(config.OutputDir, "myvm"), "-F", "raw", overlayPath},
+		d.LibvirtImgCalls,
+		"should have created an overlay backed by the disk")
+	assert.Contains(t, strings.Join(d.LibvirtCalls[0], " "), "file="+overlayPath+",", "should have booted the overlay")
+
+	step.Cleanup(state)
+	if _, err := os.Stat(step.tmpDir); !os.IsNotExist(err) {
+		t.Fatalf("Should have removed the overlays")
+	}
+}
+
+func Test_StepVerifyBootBuildVMRunning(t *testing.T) {
+	step := &stepVerifyBoot{
+		VerifyBoot: true,
+		Timeout:    verifyBootStopTimeout,
+	}
+	config := &Config{
+		Format:    "qcow2",
+		OutputDir: t.TempDir(),
+		VMName:    "myvm",
+	}
+
+	d := new(DriverMock)
+	d.WaitForShutdownState = false
+	state := verifyTestState(t, d, config)
+	action := step.Run(context.TODO(), state)
+	if action != multistep.ActionHalt {
+		t.Fatalf("Should have gotten an ActionHalt")
+	}
+
+	if d.LibvirtImgCalled || len(d.LibvirtCalls) > 0 {
+		t.Fatalf("Should not have used the disks while the build VM is running")
+	}
+}
+
+func Test_StepVerifyBootUserOverrides(t *testing.T) {
+	config := &Config{
+		OutputDir: "output/directory",
+		VMName:    "myvm",
+		LibvirtArgs: [][]string{
+			{"-drive", "file={{ .OutputDir }}/{{ .Name }},if=virtio,format=qcow2"},
+			{"-cdrom", "/path/to/extra.iso"},
+			{"-randomflag", "{{ .Name }}"},
+		},
+	}
+	step := &stepVerifyBoot{tmpDir: "verify"}
+	verifyConfig := step.verifyConfig(config)
+
+	state := runTestState(t, verifyConfig)
+	state.Put("libvirt_disk_paths", []string{filepath.Join("verify", "myvm")})
+	run := &stepRun{
+		DiskImage:       true,
+		atLeastVersion2: true,
+		ui:              packersdk.TestUi(t),
+	}
+	args, err := run.getCommandArgs(verifyConfig, state)
+	if err != nil {
+		t.Fatalf("should not have an error getting args. Error: %s", err)
+	}
+
+	command := strings.Join(args, " ")
+	assert.Contains(t, command, "-drive file="+filepath.Join("verify", "myvm")+",", "should boot the overlay")
+	assert.NotContains(t, command, "output/directory/myvm", "should not boot the image itself")
+	assert.NotContains(t, command, "-cdrom", "should not attach user drives")
+	assert.Contains(t, command, "-randomflag myvm", "should keep the other user args")
+	assert.Len(t, config.LibvirtArgs, 3, "should not modify the build configuration")
+}
+
+func Test_StepVerifyBootOverlays(t *testing.T) {
+	step := &stepVerifyBoot{tmpDir: "verify"}
+
+	d := new(DriverMock)
+	overlayPaths, err := step.createOverlays(d, "raw", []string{"/output/disk"})
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	overlayPath := filepath.Join("verify", "disk")
+	assert.Equal(t, []string{overlayPath}, overlayPaths)
+	assert.Equal(
+		t,
+		[]string{"create", "-f", "qcow2", "-b", "/output/disk", "-F", "raw", overlayPath},
+		d.LibvirtImgCalls,
+		"should have created an overlay backed by the disk")
+}
+
+func Test_StepVerifyBootSSHReady(t *testing.T) {
+	testcases := map[string]bool{
+		"SSH-2.0-OpenSSH_8.9\r\n": true,
+		"\r\n":                    false,
+	}
+
+	for banner, expected := range testcases {
+		port := fakeSSHServer(t, banner)
+		address := fmt.Sprintf("127.0.0.1:%d", port)
+		assert.Equal(t, expected, sshReady(address), "Unexpected result for banner %q", banner)
+	}
+}
@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	github.com/digitalocean/go-libvirt v0.0.0-20201209184759-e2a69bcd5bd1
+	github.com/digitalocean/go-qemu v0.0.0-20201211181942-d361e7b4965f
 	github.com/hashicorp/go-version v1.3.0
 	github.com/hashicorp/hcl/v2 v2.9.1
 	github.com/hashicorp/packer-plugin-sdk v0.2.0